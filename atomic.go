@@ -0,0 +1,73 @@
+// vim: set ts=2 sw=2 :
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// atomicWriteFile writes the content produced by write into a temp file
+// alongside finalPath, fsyncs it, and renames it into place. This avoids a
+// downstream watcher (or another instance of this program) ever observing a
+// partially written file, and ensures a crash mid-write leaves no corrupt
+// artifact at finalPath.
+func atomicWriteFile(finalPath string, write func(io.Writer) error) error {
+	dir := filepath.Dir(finalPath)
+	tmp, err := ioutil.TempFile(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	// clean up the temp file if we bail out before the rename below succeeds
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, finalPath); err != nil {
+		return err
+	}
+	succeeded = true
+	return nil
+}
+
+// moveToErrorDir relocates path into errorDir instead of deleting it, so a
+// file that failed processing is preserved for operator inspection rather
+// than silently lost. It falls back to copy-then-remove if the rename can't
+// be done in place (e.g. errorDir is on a different filesystem).
+func moveToErrorDir(path string) error {
+	dest, err := mirroredPath(path, errorDir, "")
+	if err != nil {
+		dest = filepath.Join(errorDir, filepath.Base(path))
+	}
+	if _, err := os.Stat(dest); err == nil {
+		// a per-file error report already occupies this name; don't clobber it
+		dest += ".input"
+	}
+	if err := os.Rename(path, dest); err == nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(dest, data, 0644); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,66 @@
+// vim: set ts=2 sw=2 :
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Machine-readable error codes attached to ValidationErrors. Field-specific
+// codes are built by fieldCode, e.g. a "phone" field failing its pattern
+// becomes ERR_PHONE_FORMAT.
+const (
+	// ErrHeaderMissing indicates a CSV file had no header row to read column names from
+	ErrHeaderMissing = "ERR_HEADER_MISSING"
+	// ErrRowFieldCount indicates a row had a different number of fields than the header
+	ErrRowFieldCount = "ERR_ROW_FIELD_COUNT"
+	// ErrDecode indicates the underlying format decoder failed to parse a row
+	ErrDecode = "ERR_DECODE"
+)
+
+var codeSanitizer = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// fieldCode derives a machine-readable code from a schema field name and a
+// violation kind, e.g. fieldCode("phone", "FORMAT") -> "ERR_PHONE_FORMAT" and
+// fieldCode("name.first", "LENGTH") -> "ERR_NAME_FIRST_LENGTH".
+func fieldCode(field, kind string) string {
+	upper := codeSanitizer.ReplaceAllString(strings.ToUpper(field), "_")
+	upper = strings.Trim(upper, "_")
+	return fmt.Sprintf("ERR_%s_%s", upper, kind)
+}
+
+// ValidationError is a single machine-readable violation found while
+// decoding or validating a row. Both format decoders and Schema.validate
+// produce these so callers have a consistent, structured error shape instead
+// of parsing free-form strings.
+type ValidationError struct {
+	// Field is the schema field name involved, empty for decode-level errors
+	Field string
+	// Code is a machine-readable error code, e.g. ERR_PHONE_FORMAT
+	Code string
+	// Message is a human-readable description of the violation
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+// ErrorReport is the structured, per-row error record written to a file's
+// .errors.json artifact (and used to derive the legacy LINE_NUM,ERROR_MSG
+// CSV) so downstream tooling doesn't have to scrape log lines.
+type ErrorReport struct {
+	// File is the input file the error occurred in
+	File string `json:"file"`
+	// Line is the 1-indexed row the error occurred on
+	Line int `json:"line"`
+	// Field is the schema field involved, omitted for decode-level errors
+	Field string `json:"field,omitempty"`
+	// Code is the machine-readable error code
+	Code string `json:"code"`
+	// Message is a human-readable description of the error
+	Message string `json:"message"`
+	// RawRecord is the raw decoded row that failed, when available
+	RawRecord RawRow `json:"rawRecord,omitempty"`
+}
@@ -0,0 +1,346 @@
+// vim: set ts=2 sw=2 :
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// RawRow is a single decoded row keyed by field name, before schema
+// validation/type coercion is applied. All values are kept as strings since
+// that is the lowest common denominator across our input formats.
+type RawRow map[string]string
+
+// Format describes a pluggable input/output codec. Decode streams RawRows (and
+// any row-level errors) off of r, while Encode writes a fully validated batch
+// of records to w. Formats are looked up in the registry by file extension.
+type Format interface {
+	// Decode reads r and streams decoded rows on the returned channel,
+	// closing it when done. Row-level errors are sent on the error channel
+	// rather than aborting the whole decode.
+	Decode(r io.Reader) (<-chan RawRow, <-chan error)
+	// Encode writes records to w in this format.
+	Encode(w io.Writer, records []Record) error
+}
+
+// headerLiner is an optional Format capability: formats with a header row
+// that precedes the first decoded row (currently only CSV) implement it so
+// processFile can seed its physical line counter correctly instead of
+// assuming every row starts at line 1.
+type headerLiner interface {
+	HeaderLines() int
+}
+
+// registry maps a lowercased file extension (including the leading dot) to
+// the Format that handles it.
+var registry = map[string]Format{}
+
+// registerFormat adds f to the registry under ext (e.g. ".csv").
+func registerFormat(ext string, f Format) {
+	registry[strings.ToLower(ext)] = f
+}
+
+// formatFor looks up the registered Format for ext, returning false if none
+// is registered.
+func formatFor(ext string) (Format, bool) {
+	f, ok := registry[strings.ToLower(ext)]
+	return f, ok
+}
+
+func init() {
+	registerFormat(".csv", csvFormat{})
+	registerFormat(".json", jsonFormat{})
+	registerFormat(".ndjson", ndjsonFormat{})
+	registerFormat(".xml", xmlFormat{})
+	registerFormat(".parquet", parquetFormat{})
+}
+
+// csvFormat decodes/encodes comma-separated values using the first row as the
+// header. It is the original, and still default, input format.
+type csvFormat struct{}
+
+// HeaderLines reports that CSV consumes one physical line (the header) before
+// its first decoded row, so callers seeding a line counter from Decode's
+// output can keep it aligned with the file on disk. See headerLiner.
+func (csvFormat) HeaderLines() int { return 1 }
+
+func (csvFormat) Decode(r io.Reader) (<-chan RawRow, <-chan error) {
+	rows := make(chan RawRow)
+	errs := make(chan error)
+	go func() {
+		defer close(rows)
+		defer close(errs)
+		cr := csv.NewReader(r)
+		// let rows of any width through so the field count check below
+		// reports ErrRowFieldCount instead of csv.ErrFieldCount
+		cr.FieldsPerRecord = -1
+		var header []string
+		sawAnyLine := false
+		for line := 1; ; line++ {
+			record, err := cr.Read()
+			if err == io.EOF {
+				break
+			}
+			sawAnyLine = true
+			if err != nil {
+				errs <- &ValidationError{Code: ErrDecode, Message: fmt.Sprintf("line %d: %v", line, err)}
+				continue
+			}
+			if header == nil {
+				header = record
+				continue
+			}
+			if len(record) != len(header) {
+				errs <- &ValidationError{Code: ErrRowFieldCount, Message: fmt.Sprintf("line %d: number of fields: %d does not match header: %d", line, len(record), len(header))}
+				continue
+			}
+			row := make(RawRow, len(header))
+			for i, val := range record {
+				row[header[i]] = val
+			}
+			rows <- row
+		}
+		if !sawAnyLine {
+			errs <- &ValidationError{Code: ErrHeaderMissing, Message: "err: no header row found"}
+		}
+	}()
+	return rows, errs
+}
+
+func (csvFormat) Encode(w io.Writer, records []Record) error {
+	cw := csv.NewWriter(w)
+	defer cw.Flush()
+	flattened := make([]map[string]string, len(records))
+	for i, rec := range records {
+		flattened[i] = flattenRecord(rec)
+	}
+	fields := fieldOrder(flattened)
+	if err := cw.Write(fields); err != nil {
+		return err
+	}
+	for _, row := range flattened {
+		out := make([]string, len(fields))
+		for i, f := range fields {
+			out[i] = row[f]
+		}
+		if err := cw.Write(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonFormat decodes a JSON array of objects and encodes records as a single
+// indented JSON array, matching the program's historical output shape.
+type jsonFormat struct{}
+
+func (jsonFormat) Decode(r io.Reader) (<-chan RawRow, <-chan error) {
+	rows := make(chan RawRow)
+	errs := make(chan error)
+	go func() {
+		defer close(rows)
+		defer close(errs)
+		var raw []map[string]interface{}
+		if err := json.NewDecoder(r).Decode(&raw); err != nil {
+			errs <- err
+			return
+		}
+		for _, obj := range raw {
+			row := make(RawRow, len(obj))
+			for k, v := range obj {
+				row[k] = fmt.Sprintf("%v", v)
+			}
+			rows <- row
+		}
+	}()
+	return rows, errs
+}
+
+func (jsonFormat) Encode(w io.Writer, records []Record) error {
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// ndjsonFormat encodes records one-per-line as newline-delimited JSON, useful
+// for streaming consumers that don't want to buffer a whole array.
+type ndjsonFormat struct{}
+
+func (ndjsonFormat) Decode(r io.Reader) (<-chan RawRow, <-chan error) {
+	rows := make(chan RawRow)
+	errs := make(chan error)
+	go func() {
+		defer close(rows)
+		defer close(errs)
+		dec := json.NewDecoder(r)
+		for dec.More() {
+			var obj map[string]interface{}
+			if err := dec.Decode(&obj); err != nil {
+				errs <- err
+				return
+			}
+			row := make(RawRow, len(obj))
+			for k, v := range obj {
+				row[k] = fmt.Sprintf("%v", v)
+			}
+			rows <- row
+		}
+	}()
+	return rows, errs
+}
+
+func (ndjsonFormat) Encode(w io.Writer, records []Record) error {
+	enc := json.NewEncoder(w)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// xmlFormat encodes records wrapped in a <records><record>...</record></records>
+// document. It is output-only; there is no known XML input source today.
+type xmlFormat struct{}
+
+// xmlRecord adapts the generic Record map to an element with nested fields,
+// since encoding/xml cannot marshal map[string]interface{} directly.
+type xmlRecord struct {
+	XMLName xml.Name `xml:"record"`
+	Fields  []xmlField
+}
+
+type xmlField struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+func (xmlRecord) fromRecord(rec Record) xmlRecord {
+	out := xmlRecord{XMLName: xml.Name{Local: "record"}}
+	flat := flattenRecord(rec)
+	for _, k := range sortedKeys(flat) {
+		out.Fields = append(out.Fields, xmlField{XMLName: xml.Name{Local: k}, Value: flat[k]})
+	}
+	return out
+}
+
+func (xmlFormat) Decode(r io.Reader) (<-chan RawRow, <-chan error) {
+	rows := make(chan RawRow)
+	errs := make(chan error)
+	close(rows)
+	go func() {
+		defer close(errs)
+		errs <- fmt.Errorf("xml decoding is not supported")
+	}()
+	return rows, errs
+}
+
+func (xmlFormat) Encode(w io.Writer, records []Record) error {
+	type document struct {
+		XMLName xml.Name    `xml:"records"`
+		Records []xmlRecord `xml:"record"`
+	}
+	doc := document{}
+	for _, rec := range records {
+		doc.Records = append(doc.Records, xmlRecord{}.fromRecord(rec))
+	}
+	data, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// parquetFormat is registered under ".parquet" so -output-format parquet (and
+// a *.parquet input file) fails with an explicit "not implemented" error
+// instead of "unknown output format", but encoding/decoding themselves are
+// not implemented; there is no pure-Go parquet dependency vendored yet.
+type parquetFormat struct{}
+
+func (parquetFormat) Decode(r io.Reader) (<-chan RawRow, <-chan error) {
+	rows := make(chan RawRow)
+	errs := make(chan error)
+	close(rows)
+	go func() {
+		defer close(errs)
+		errs <- fmt.Errorf("parquet decoding is not implemented yet")
+	}()
+	return rows, errs
+}
+
+func (parquetFormat) Encode(w io.Writer, records []Record) error {
+	return fmt.Errorf("parquet encoding is not implemented yet")
+}
+
+// fieldOrder returns a stable, alphabetically sorted list of field names
+// across all flattened rows, used so CSV output has a consistent column
+// order even when some rows are missing a field another row has.
+func fieldOrder(rows []map[string]string) []string {
+	seen := map[string]struct{}{}
+	for _, row := range rows {
+		for k := range row {
+			seen[k] = struct{}{}
+		}
+	}
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedKeys(row map[string]string) []string {
+	keys := make([]string, 0, len(row))
+	for k := range row {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// flattenRecord expands a Record's nested Records (produced by setNested for
+// dotted schema field names, e.g. "name.first") into a flat map keyed by the
+// same dotted path, so text-based formats like CSV and XML render leaf
+// values instead of Go's default map formatting.
+func flattenRecord(rec Record) map[string]string {
+	out := map[string]string{}
+	flattenInto(rec, "", out)
+	return out
+}
+
+func flattenInto(rec Record, prefix string, out map[string]string) {
+	for k, v := range rec {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		if nested, ok := v.(Record); ok {
+			flattenInto(nested, key, out)
+			continue
+		}
+		out[key] = formatValue(v)
+	}
+}
+
+// formatValue renders a scalar leaf value for text-based output formats,
+// treating a missing/nil value as an empty string rather than the "<nil>"
+// that fmt.Sprintf("%v", nil) would otherwise produce.
+func formatValue(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", v)
+}
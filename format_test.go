@@ -0,0 +1,196 @@
+// vim: set ts=2 sw=2 :
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// drain reads every RawRow (and error) off a Decode call's channels.
+func drain(rows <-chan RawRow, errs <-chan error) ([]RawRow, []error) {
+	var gotRows []RawRow
+	var gotErrs []error
+	rowsOpen, errsOpen := true, true
+	for rowsOpen || errsOpen {
+		select {
+		case r, ok := <-rows:
+			if !ok {
+				rowsOpen = false
+				rows = nil
+				continue
+			}
+			gotRows = append(gotRows, r)
+		case e, ok := <-errs:
+			if !ok {
+				errsOpen = false
+				errs = nil
+				continue
+			}
+			gotErrs = append(gotErrs, e)
+		}
+	}
+	return gotRows, gotErrs
+}
+
+// TestCSVFormatRoundTrip decodes a simple CSV and re-encodes it, checking the
+// header survives intact.
+func TestCSVFormatRoundTrip(t *testing.T) {
+	input := "id,name\n1,Alice\n2,Bob\n"
+	rows, errs := csvFormat{}.Decode(strings.NewReader(input))
+	gotRows, gotErrs := drain(rows, errs)
+	if len(gotErrs) != 0 {
+		t.Fatalf("unexpected decode errors: %v", gotErrs)
+	}
+	if len(gotRows) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(gotRows))
+	}
+
+	records := []Record{
+		{"id": gotRows[0]["id"], "name": gotRows[0]["name"]},
+		{"id": gotRows[1]["id"], "name": gotRows[1]["name"]},
+	}
+	var buf bytes.Buffer
+	if err := (csvFormat{}).Encode(&buf, records); err != nil {
+		t.Fatal(err)
+	}
+	want := "id,name\n1,Alice\n2,Bob\n"
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+// TestCSVFormatEncodeNestedRecord guards against the map stringified into a
+// cell: a nested Record (as produced by setNested for dotted schema field
+// names) must be flattened into dotted columns, not rendered as Go's
+// map[key:value] syntax.
+func TestCSVFormatEncodeNestedRecord(t *testing.T) {
+	records := []Record{
+		{"id": "1", "name": Record{"first": "John", "last": "Doe"}},
+	}
+	var buf bytes.Buffer
+	if err := (csvFormat{}).Encode(&buf, records); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if strings.Contains(out, "map[") {
+		t.Fatalf("nested record was stringified instead of flattened: %s", out)
+	}
+	want := "id,name.first,name.last\n1,John,Doe\n"
+	if out != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+// TestCSVFormatEncodeMissingField guards against fmt.Sprintf("%v", nil)
+// rendering "<nil>" for a field present on a sibling record but absent on
+// this one.
+func TestCSVFormatEncodeMissingField(t *testing.T) {
+	records := []Record{
+		{"id": "1", "note": "hi"},
+		{"id": "2"},
+	}
+	var buf bytes.Buffer
+	if err := (csvFormat{}).Encode(&buf, records); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if strings.Contains(out, "<nil>") {
+		t.Fatalf("missing field rendered as <nil>: %s", out)
+	}
+	want := "id,note\n1,hi\n2,\n"
+	if out != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+// TestXMLFormatEncodeNestedRecord mirrors TestCSVFormatEncodeNestedRecord for
+// the XML encoder, which shares the same flattening helper.
+func TestXMLFormatEncodeNestedRecord(t *testing.T) {
+	records := []Record{
+		{"name": Record{"first": "John"}},
+	}
+	var buf bytes.Buffer
+	if err := (xmlFormat{}).Encode(&buf, records); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if strings.Contains(out, "map[") {
+		t.Fatalf("nested record was stringified instead of flattened: %s", out)
+	}
+	if !strings.Contains(out, "<name.first>John</name.first>") {
+		t.Errorf("expected flattened <name.first> element, got: %s", out)
+	}
+}
+
+// TestJSONFormatRoundTrip decodes and re-encodes a JSON array.
+func TestJSONFormatRoundTrip(t *testing.T) {
+	input := `[{"id":"1"},{"id":"2"}]`
+	rows, errs := jsonFormat{}.Decode(strings.NewReader(input))
+	gotRows, gotErrs := drain(rows, errs)
+	if len(gotErrs) != 0 {
+		t.Fatalf("unexpected decode errors: %v", gotErrs)
+	}
+	if len(gotRows) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(gotRows))
+	}
+
+	var buf bytes.Buffer
+	records := []Record{{"id": gotRows[0]["id"]}, {"id": gotRows[1]["id"]}}
+	if err := (jsonFormat{}).Encode(&buf, records); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"id": "1"`) {
+		t.Errorf("expected encoded JSON to contain id 1, got: %s", buf.String())
+	}
+}
+
+// TestNDJSONFormatRoundTrip decodes one-record-per-line input and re-encodes
+// it the same way.
+func TestNDJSONFormatRoundTrip(t *testing.T) {
+	input := "{\"id\":\"1\"}\n{\"id\":\"2\"}\n"
+	rows, errs := ndjsonFormat{}.Decode(strings.NewReader(input))
+	gotRows, gotErrs := drain(rows, errs)
+	if len(gotErrs) != 0 {
+		t.Fatalf("unexpected decode errors: %v", gotErrs)
+	}
+	if len(gotRows) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(gotRows))
+	}
+
+	var buf bytes.Buffer
+	records := []Record{{"id": gotRows[0]["id"]}, {"id": gotRows[1]["id"]}}
+	if err := (ndjsonFormat{}).Encode(&buf, records); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d: %q", len(lines), buf.String())
+	}
+}
+
+// TestCSVFormatHeaderLines checks csvFormat reports the one physical header
+// line it consumes before its first row, so processFile can seed its line
+// counter past it instead of reporting every row one line early.
+func TestCSVFormatHeaderLines(t *testing.T) {
+	hl, ok := Format(csvFormat{}).(headerLiner)
+	if !ok {
+		t.Fatal("expected csvFormat to implement headerLiner")
+	}
+	if hl.HeaderLines() != 1 {
+		t.Errorf("expected 1 header line, got %d", hl.HeaderLines())
+	}
+}
+
+// TestParquetFormatNotImplemented checks the stub registered for .parquet
+// fails loudly instead of silently dropping data.
+func TestParquetFormatNotImplemented(t *testing.T) {
+	if err := (parquetFormat{}).Encode(&bytes.Buffer{}, nil); err == nil {
+		t.Fatal("expected an error from parquetFormat.Encode")
+	}
+	rows, errs := parquetFormat{}.Decode(strings.NewReader(""))
+	_, gotErrs := drain(rows, errs)
+	if len(gotErrs) == 0 {
+		t.Fatal("expected an error from parquetFormat.Decode")
+	}
+}
@@ -4,16 +4,15 @@ package main
 import (
 	"encoding/csv"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"regexp"
-	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	flag "github.com/namsral/flag"
@@ -33,32 +32,72 @@ const (
 	Phone = "PHONE_NUM"
 )
 
-// Name provides fields describing a name for our output schema
-type Name struct {
-	// First is the first name
-	First string `json:"first"`
-	// Middle is the middle name which can be empty
-	Middle string `json:"middle,omitempty"`
-	// Last is the last name
-	Last string `json:"last"`
-}
+// Record is a generic, schema-shaped output record. It replaced the
+// hard-coded ID/Name/Phone struct so the same binary can emit arbitrary
+// record shapes driven entirely by the -schema file. Nested fields (e.g.
+// "name.first" in the schema) become nested Records.
+type Record map[string]interface{}
+
+// builtinSchema reproduces the original ID/FIRST_NAME/MIDDLE_NAME/LAST_NAME/
+// PHONE_NUM validation rules as a Schema, used when no -schema file is given
+// so existing deployments keep the same output fields and validation limits.
+// Error messages and codes come from Schema.validate, which reports every
+// failing field of a row rather than only the first.
+var builtinSchema = func() *Schema {
+	min0 := 0.0
+	s := &Schema{Fields: []FieldRule{
+		{Name: "id", Source: ID, Type: "int", Required: true, Pattern: `^\d{8}$`, Min: &min0},
+		{Name: "name.first", Source: FName, Required: true, MaxLength: 15},
+		{Name: "name.middle", Source: MName, MaxLength: 15},
+		{Name: "name.last", Source: LName, Required: true, MaxLength: 15},
+		{Name: "phone", Source: Phone, Required: true, Pattern: `^\d{3}-\d{3}-\d{4}$`},
+	}}
+	if err := s.compile(); err != nil {
+		panic(err)
+	}
+	return s
+}()
 
-// Record provides the fields describing the record we wish to output
-type Record struct {
-	// InternalID is the 8 digit positive id number for our record
-	InternalID int `json:"id"`
-	// Name is the person's name
-	Name Name `json:"name"`
-	// Phone is the person's phone number
-	Phone string `json:"phone"`
+// ProcessResult summarizes the outcome of processing a single file, returned
+// by processFile so callers can aggregate logging across workers.
+type ProcessResult struct {
+	// Path is the input file that was processed
+	Path string
+	// RecordsWritten is the number of records successfully written to the output
+	RecordsWritten int
+	// ErrorRows is the number of rows that failed validation, plus one for
+	// each decode error
+	ErrorRows int
+	// Duration is how long processing the file took
+	Duration time.Duration
 }
 
 var (
-	inputDir    string
-	outputDir   string
-	errorDir    string
-	logLevel    string
-	phoneRegexp *regexp.Regexp = regexp.MustCompile("^\\d{3}-\\d{3}-\\d{4}$")
+	inputDir     string
+	outputDir    string
+	errorDir     string
+	logLevel     string
+	numWorkers   int
+	queueSize    int
+	outputFormat string
+	schemaPath   string
+	inputPattern string
+	recursive    bool
+	stateDir     string
+	reprocess    string
+
+	// stateStore is nil unless -state-dir is set, in which case successfully
+	// processed files are skipped on restart.
+	stateStore *StateStore
+
+	// activeSchema is the schema applied to every decoded row. It defaults to
+	// builtinSchema and is replaced in init if -schema is given.
+	activeSchema = builtinSchema
+
+	// inFlight tracks paths that are currently queued or being processed so
+	// rapid duplicate fsnotify events (e.g. Write immediately following
+	// Create) don't enqueue the same file twice.
+	inFlight sync.Map
 )
 
 // init sets up our flags and initializes our logger
@@ -67,6 +106,15 @@ func init() {
 	flag.StringVar(&outputDir, "output-directory", "./output", "directory to output json files to")
 	flag.StringVar(&errorDir, "error-directory", "./errors", "directory to output error files to")
 	flag.StringVar(&logLevel, "log-level", "info", "log level can be one of (panic,error,warn,info,debug,trace)")
+	flag.IntVar(&numWorkers, "workers", 4, "number of worker goroutines processing files concurrently")
+	flag.IntVar(&queueSize, "queue-size", 64, "size of the buffered job queue; enqueueing blocks once full to apply backpressure")
+	flag.StringVar(&outputFormat, "output-format", "json", "output format: one of (json,ndjson,xml,csv); parquet is registered but not yet implemented and fails with an explicit error")
+	flag.StringVar(&schemaPath, "schema", "", "path to a JSON/YAML schema file describing field mappings and validation; defaults to the built-in ID/name/phone schema")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "address to serve Prometheus /metrics on, e.g. :9090; disabled if empty")
+	flag.StringVar(&inputPattern, "input-pattern", "*.csv", "doublestar glob (relative to input-directory) matching files to process, e.g. `**/*.{csv,tsv}`; defaults to `**/*.csv` instead when -recursive is set and this flag is left unset")
+	flag.BoolVar(&recursive, "recursive", false, "recurse into subdirectories of input-directory, watching each for new files")
+	flag.StringVar(&stateDir, "state-dir", "", "directory to persist a processing state manifest in, enabling resumable restarts; disabled if empty")
+	flag.StringVar(&reprocess, "reprocess", "", "clear state for the given input path so it is reprocessed on next run, then exit; requires -state-dir")
 	flag.Parse()
 	logrus.SetFormatter(&logrus.JSONFormatter{})
 	level, err := logrus.ParseLevel(logLevel)
@@ -74,19 +122,79 @@ func init() {
 		logrus.WithError(err).Fatal()
 	}
 	logrus.SetLevel(level)
+	if schemaPath != "" {
+		schema, err := loadSchema(schemaPath)
+		if err != nil {
+			logrus.WithError(err).Fatal("could not load schema")
+		}
+		activeSchema = schema
+	}
+	if _, ok := registry["."+strings.TrimPrefix(outputFormat, ".")]; !ok {
+		logrus.WithField("output-format", outputFormat).Fatal("unknown output format")
+	}
+	if stateDir != "" {
+		store, err := loadStateStore(stateDir)
+		if err != nil {
+			logrus.WithError(err).Fatal("could not load state store")
+		}
+		stateStore = store
+	}
+	if reprocess != "" && stateStore == nil {
+		logrus.Fatal("-reprocess requires -state-dir to be set")
+	}
+	if recursive {
+		patternExplicit := false
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "input-pattern" {
+				patternExplicit = true
+			}
+		})
+		if !patternExplicit {
+			// The default "*.csv" only matches files directly in
+			// input-directory, since doublestar's single "*" never crosses
+			// a "/". Without this, -recursive alone would watch every
+			// subdirectory but never enqueue anything found in one.
+			inputPattern = "**/*.csv"
+		} else if !strings.Contains(inputPattern, "**") {
+			logrus.WithField("input-pattern", inputPattern).Warn("-recursive is set but -input-pattern has no ** component, so files in subdirectories of input-directory will never match; consider a pattern like **/*.csv")
+		}
+	}
 }
 
 func main() {
+	if reprocess != "" {
+		if err := stateStore.clear(reprocess); err != nil {
+			logrus.WithError(err).WithField("path", reprocess).Fatal("could not clear state for path")
+		}
+		logrus.WithField("path", reprocess).Info("cleared state; the file will be reprocessed next run if it is still present in input-directory")
+		return
+	}
+
+	serveMetrics(metricsAddr)
+
 	// create a new file watcher using fsnotify to watch for new files
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		logrus.WithError(err).Fatal("could not initialize watcher")
 	}
 	defer watcher.Close()
-	var wg sync.WaitGroup
-	wg.Add(1)
+
+	// jobs is the bounded queue shared by the initial glob scan and the
+	// fsnotify loop; a full queue blocks the enqueuer, which is how
+	// backpressure keeps a burst of files from serializing behind the watcher.
+	jobs := make(chan string, queueSize)
+	done := make(chan struct{})
+
+	var workerWg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		workerWg.Add(1)
+		go worker(i, jobs, &workerWg)
+	}
+
+	var watchWg sync.WaitGroup
+	watchWg.Add(1)
 	go func() {
-		defer wg.Done()
+		defer watchWg.Done()
 		for {
 			select {
 			case event, ok := <-watcher.Events:
@@ -94,12 +202,19 @@ func main() {
 					return
 				}
 				logrus.WithField("event", event).Trace("received file event")
+				if event.Op&fsnotify.Create == fsnotify.Create && recursive {
+					if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+						if err := watcher.Add(event.Name); err != nil {
+							logrus.WithError(err).WithField("directory", event.Name).Error("could not watch new subdirectory")
+						} else {
+							logrus.WithField("directory", event.Name).Info("watching new subdirectory")
+						}
+						continue
+					}
+				}
 				if event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create {
-					// handle write or create file events and send them to our file processor
-					logrus.WithField("file", event.Name).Info("processing csv file")
-					err = processFile(event.Name)
-					if err != nil {
-						logrus.WithField("file", event.Name).WithError(err).Error()
+					if matchesPattern(event.Name, inputPattern) {
+						enqueue(jobs, event.Name)
 					}
 				}
 			case err, ok := <-watcher.Errors:
@@ -107,193 +222,246 @@ func main() {
 					return
 				}
 				logrus.WithError(err).Error()
+			case <-done:
+				return
 			}
 		}
 	}()
+
 	// process initial files since fsnotify only looks for new files, and there may be files already
 	// in the directory
-	files, err := filepath.Glob(filepath.Join(inputDir, "*.csv"))
+	files, err := scanInputDir(inputPattern, recursive)
 	if err != nil {
 		logrus.WithError(err).Fatal()
 	}
 	for _, file := range files {
-		logrus.WithField("file", file).Info("processing csv file")
-		err = processFile(file)
-		if err != nil {
-			logrus.WithField("file", file).WithError(err).Error()
+		if stateStore != nil && stateStore.alreadySucceeded(file) {
+			logrus.WithField("file", file).Info("skipping file already marked succeeded in state store")
+			continue
 		}
+		enqueue(jobs, file)
 	}
 
-	// set up file watcher to watch our input dir for any new files
-	err = watcher.Add(inputDir)
+	// set up file watcher to watch our input dir for any new files, walking
+	// into subdirectories when -recursive is set
+	if recursive {
+		err = addRecursiveWatches(watcher, inputDir)
+	} else {
+		err = watcher.Add(inputDir)
+	}
 	if err != nil {
 		logrus.WithError(err).WithField("input-directory", inputDir).Fatal("could not watch directory")
 	}
 
-	wg.Wait()
+	// wait for SIGINT/SIGTERM and shut down gracefully, draining in-flight jobs
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	<-sigCh
+	logrus.Info("shutdown signal received, draining in-flight jobs")
+	close(done)
+	watcher.Close()
+	watchWg.Wait()
+	close(jobs)
+	workerWg.Wait()
+	logrus.Info("shutdown complete")
 }
 
-// processFile will process a file at the given path and return an error if it cannot process the file
-func processFile(path string) error {
-	var records []Record
-	// prepare the error list for export to csv if needed
-	errs := [][]string{
-		{
-			"LINE_NUM",
-			"ERROR_MSG",
-		},
+// enqueue adds path to the job queue unless it is already queued or being
+// processed, coalescing rapid Write+Create events fsnotify may emit for the
+// same file.
+func enqueue(jobs chan<- string, path string) {
+	if _, loaded := inFlight.LoadOrStore(path, struct{}{}); loaded {
+		logrus.WithField("file", path).Trace("skipping duplicate in-flight file event")
+		return
 	}
+	jobs <- path
+}
 
-	// create a small helper function to save on repeated code when handling errors
-	errFunc := func(line int, err error) {
-		logrus.WithError(err).WithField("lineNumber", line).Error()
-		errs = append(errs, []string{fmt.Sprintf("%d", line), err.Error()})
+// worker pulls paths off jobs until it is closed, processing each with
+// processFile and logging an aggregated summary of the result.
+func worker(id int, jobs <-chan string, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for path := range jobs {
+		logrus.WithFields(logrus.Fields{"worker": id, "file": path}).Info("processing csv file")
+		result, err := processFile(path)
+		inFlight.Delete(path)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"worker": id, "file": path}).WithError(err).Error()
+			continue
+		}
+		logrus.WithFields(logrus.Fields{
+			"worker":          id,
+			"file":            path,
+			"records_written": result.RecordsWritten,
+			"error_rows":      result.ErrorRows,
+			"duration":        result.Duration.String(),
+		}).Info("finished processing csv file")
 	}
+}
 
-	ext := filepath.Ext(path)
+// processFile will process a file at the given path, returning a ProcessResult
+// summarizing the outcome or an error if it cannot process the file. The
+// input format is auto-detected from the file extension via the format
+// registry, and every row is validated/mapped through activeSchema.
+func processFile(path string) (result ProcessResult, err error) {
+	start := time.Now()
+	result = ProcessResult{Path: path}
 
-	if strings.ToLower(ext) == ".csv" {
-		// open the csv file for reading
-		f, err := os.Open(path)
+	// Every early return below with a non-nil err means this input could
+	// not be fully processed; route all of them through the same
+	// move-to-error-directory handling the later failure paths already
+	// had, instead of leaving the input sitting untouched in input-directory
+	// to be retried (and fail the same way) forever.
+	defer func() {
 		if err != nil {
-			return err
-		}
-		r := csv.NewReader(f)
-
-		var header map[string]int
-		// loop through the csv file line by line and process each line
-		for line := 1; ; line++ {
-			record, err := r.Read()
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				errFunc(line, err)
-				continue
-			}
-			// create a map to store the table column positions using the data in the first row
-			if header == nil {
-				header = make(map[string]int)
-				for i, val := range record {
-					header[val] = i
-				}
-				continue
-			}
-			// make sure the record has the same amount of fields as the header
-			if len(record) != len(header) {
-				errFunc(line, fmt.Errorf("err: number of fields: %d does not match header: %d", len(record), len(header)))
-				continue
-			}
-			rec := Record{}
-			id, exists := header[ID]
-			if !exists {
-				errFunc(line, fmt.Errorf("err: missing: %q error field in header", ID))
-				continue
-			}
-			if len(record[id]) != 8 {
-				errFunc(line, fmt.Errorf("err: id field: %q is not an 8 digit integer", record[id]))
-				continue
-			}
-			rec.InternalID, err = strconv.Atoi(record[id])
-			if err != nil {
-				errFunc(line, fmt.Errorf("err: id field: %q either empty, or an invalid integer, %v", record[id], err))
-				continue
-			}
-			if rec.InternalID < 0 {
-				errFunc(line, fmt.Errorf("err: id: %d should not be negative", rec.InternalID))
-				continue
+			recordState(path, StateFailed, "", err.Error())
+			if moveErr := moveToErrorDir(path); moveErr != nil {
+				logrus.WithError(moveErr).WithField("file", path).Error("could not move failed input to error directory")
 			}
+		}
+	}()
 
-			id, exists = header[FName]
-			if !exists {
-				errFunc(line, fmt.Errorf("err: missing: %q error field in header", FName))
-				continue
-			}
-			if len(record[id]) > 15 {
-				errFunc(line, fmt.Errorf("err: first name field: %q should not exceed 15 characters", record[id]))
-				continue
-			}
-			rec.Name.First = record[id]
-			if rec.Name.First == "" {
-				errFunc(line, errors.New("err: first name field should not be empty"))
-				continue
-			}
-			id, exists = header[MName]
-			if !exists {
-				errFunc(line, fmt.Errorf("err: missing: %q error field in header", MName))
-				continue
-			}
-			if len(record[id]) > 15 {
-				errFunc(line, fmt.Errorf("err: middle name field: %q should not exceed 15 characters", record[id]))
-				continue
-			}
-			rec.Name.Middle = record[id]
-			id, exists = header[LName]
-			if !exists {
-				errFunc(line, fmt.Errorf("err: missing: %q error field in header", LName))
+	ext := filepath.Ext(path)
+	decoder, ok := formatFor(ext)
+	if !ok {
+		err = fmt.Errorf("err: no format registered for extension %q", ext)
+		return result, err
+	}
+
+	var reports []ErrorReport
+	report := func(line int, field, code, message string, raw RawRow) {
+		logrus.WithFields(logrus.Fields{"lineNumber": line, "code": code}).Error(message)
+		reports = append(reports, ErrorReport{File: path, Line: line, Field: field, Code: code, Message: message, RawRecord: raw})
+		recordErrorsTotal.WithLabelValues(code).Inc()
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return result, err
+	}
+	rows, decodeErrs := decoder.Decode(f)
+
+	var records []Record
+	errorRows := 0
+	// line tracks the physical file line the next decoded row/error
+	// corresponds to; formats with a header (headerLiner) consume lines
+	// before their first row, so seed past those instead of assuming the
+	// first row is always on line 1.
+	line := 1
+	if hl, ok := decoder.(headerLiner); ok {
+		line += hl.HeaderLines()
+	}
+	for rows != nil || decodeErrs != nil {
+		select {
+		case row, ok := <-rows:
+			if !ok {
+				rows = nil
 				continue
 			}
-			if len(record[id]) > 15 {
-				errFunc(line, fmt.Errorf("err: last name field: %q should not exceed 15 characters", record[id]))
-				continue
+			rec, valErrs := activeSchema.validate(row)
+			for _, verr := range valErrs {
+				report(line, verr.Field, verr.Code, verr.Message, row)
 			}
-			rec.Name.Last = record[id]
-			if rec.Name.Last == "" {
-				errFunc(line, errors.New("err: last name field should not be empty"))
-				continue
+			if len(valErrs) == 0 {
+				records = append(records, rec)
+			} else {
+				errorRows++
 			}
-			id, exists = header[Phone]
-			if !exists {
-				errFunc(line, fmt.Errorf("err: missing: %q error field in header", Phone))
+			line++
+		case decErr, ok := <-decodeErrs:
+			if !ok {
+				decodeErrs = nil
 				continue
 			}
-			rec.Phone = record[id]
-			if !phoneRegexp.MatchString(rec.Phone) {
-				errFunc(line, fmt.Errorf("err: phone field: %q either empty, or an invalid phone number", rec.Phone))
-				continue
+			if verr, ok := decErr.(*ValidationError); ok {
+				report(line, verr.Field, verr.Code, verr.Message, nil)
+			} else {
+				report(line, "", ErrDecode, decErr.Error(), nil)
 			}
-			// add the processed record to our output list
-			records = append(records, rec)
+			errorRows++
+			line++
 		}
-		// close out the file
-		f.Close()
+	}
+	f.Close()
 
-		// marshal our records to json
-		data, err := json.MarshalIndent(records, "", "  ")
+	encoder, ok := formatFor("." + strings.TrimPrefix(outputFormat, "."))
+	if !ok {
+		return result, fmt.Errorf("err: no format registered for output format %q", outputFormat)
+	}
+
+	// write our encoded output to the output directory: temp file + fsync +
+	// rename, so a downstream watcher never observes a partial file and a
+	// crash mid-write can't leave a corrupt artifact. The output mirrors the
+	// input's path relative to input-directory so tenant-partitioned trees
+	// aren't flattened.
+	outPath, err := mirroredPath(path, outputDir, outputFormat)
+	if err != nil {
+		return result, err
+	}
+	if err := atomicWriteFile(outPath, func(w io.Writer) error {
+		return encoder.Encode(w, records)
+	}); err != nil {
+		return result, err
+	}
+	// if we collected any errors, write both the legacy LINE_NUM,ERROR_MSG csv
+	// and a structured .errors.json artifact for downstream tooling
+	if len(reports) > 0 {
+		errPath, err := mirroredPath(path, errorDir, "")
 		if err != nil {
-			return err
+			return result, err
 		}
-		// write our json data to the output directory
-		err = ioutil.WriteFile(
-			filepath.Join(
-				outputDir,
-				strings.Join([]string{strings.TrimSuffix(filepath.Base(path), ext), "json"}, "."),
-			), data, 0755)
-		if err != nil {
-			return err
+		if err := atomicWriteFile(errPath, func(w io.Writer) error {
+			return csv.NewWriter(w).WriteAll(errorReportsToCSV(reports))
+		}); err != nil {
+			return result, err
 		}
-		// if our errors list has errors in it write the error csv to the errors dir
-		if len(errs) > 1 {
-			errFile, err := os.OpenFile(
-				filepath.Join(errorDir, filepath.Base(path)),
-				os.O_RDWR|os.O_CREATE|os.O_TRUNC,
-				0755,
-			)
-			if err != nil {
-				logrus.WithError(err).Fatal()
-			}
-			defer errFile.Close()
-			w := csv.NewWriter(errFile)
-			err = w.WriteAll(errs)
-			if err != nil {
-				logrus.WithError(err).Fatal()
-			}
+		jsonPath := errPath + ".errors.json"
+		if err := atomicWriteFile(jsonPath, func(w io.Writer) error {
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			return enc.Encode(reports)
+		}); err != nil {
+			return result, err
 		}
-		// remove the processed file
-		err = os.Remove(path)
-		if err != nil {
-			return err
+	}
+	// record success in the state store before removing the input, so a
+	// crash between the two leaves the state store (not the input's absence)
+	// as the source of truth on the next restart
+	recordState(path, StateSucceeded, outPath, "")
+	// only remove the input once the output (and any error report) are safely on disk
+	if err := os.Remove(path); err != nil {
+		logrus.WithError(err).WithField("file", path).Error("could not remove processed input, moving to error directory instead")
+		if moveErr := moveToErrorDir(path); moveErr != nil {
+			logrus.WithError(moveErr).WithField("file", path).Error("could not move input to error directory")
 		}
 	}
-	return nil
+
+	result.RecordsWritten = len(records)
+	result.ErrorRows = errorRows
+	result.Duration = time.Since(start)
+	filesProcessedTotal.Inc()
+	recordsEmittedTotal.Add(float64(len(records)))
+	fileProcessingDuration.Observe(result.Duration.Seconds())
+	return result, nil
+}
+
+// recordState updates the state store for path if one is configured (-state-dir),
+// logging but not failing processing if the store write itself errors.
+func recordState(path string, status StateStatus, outputPath, errMsg string) {
+	if stateStore == nil {
+		return
+	}
+	if err := stateStore.record(path, status, outputPath, errMsg); err != nil {
+		logrus.WithError(err).WithField("file", path).Error("could not update state store")
+	}
+}
+
+// errorReportsToCSV renders reports as rows for the legacy LINE_NUM,ERROR_MSG
+// error csv kept for backwards compatibility with existing consumers.
+func errorReportsToCSV(reports []ErrorReport) [][]string {
+	rows := [][]string{{"LINE_NUM", "ERROR_MSG"}}
+	for _, r := range reports {
+		rows = append(rows, []string{fmt.Sprintf("%d", r.Line), r.Message})
+	}
+	return rows
 }
@@ -0,0 +1,112 @@
+// vim: set ts=2 sw=2 :
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestEnqueueDedupCollapsesToOneJob exercises the in-flight dedup that
+// coalesces rapid duplicate fsnotify events (e.g. Write immediately
+// following Create) for the same path into a single job. Run with -race.
+func TestEnqueueDedupCollapsesToOneJob(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dup.csv")
+	defer inFlight.Delete(path)
+
+	jobs := make(chan string, 50)
+	var wg sync.WaitGroup
+	const n = 20
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			enqueue(jobs, path)
+		}()
+	}
+	wg.Wait()
+	close(jobs)
+
+	count := 0
+	for range jobs {
+		count++
+	}
+	if count != 1 {
+		t.Fatalf("expected duplicate concurrent enqueue(%q) calls to collapse to 1 job, got %d", path, count)
+	}
+}
+
+// TestEnqueueDedupReleasesAfterWorkerProcesses checks that once a worker
+// finishes a job (deleting it from inFlight), the same path can be enqueued
+// again - dedup should only coalesce events for a job still in flight.
+func TestEnqueueDedupReleasesAfterWorkerProcesses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dup.csv")
+	defer inFlight.Delete(path)
+
+	jobs := make(chan string, 1)
+	enqueue(jobs, path)
+	<-jobs
+	inFlight.Delete(path) // mirrors worker() deleting the path once processFile returns
+
+	enqueue(jobs, path)
+	select {
+	case got := <-jobs:
+		if got != path {
+			t.Fatalf("got %q, want %q", got, path)
+		}
+	default:
+		t.Fatal("expected enqueue to accept the path again once it was no longer in flight")
+	}
+}
+
+// TestWorkerDrainsQueueBeforeShutdownCompletes mirrors main()'s shutdown
+// sequence: close the job queue, then wait for the worker pool. Every
+// enqueued file must be fully processed (output written, input removed)
+// before that wait returns, so a SIGINT/SIGTERM never drops in-flight work.
+func TestWorkerDrainsQueueBeforeShutdownCompletes(t *testing.T) {
+	origIn, origOut, origErr := inputDir, outputDir, errorDir
+	inputDir, outputDir, errorDir = t.TempDir(), t.TempDir(), t.TempDir()
+	defer func() { inputDir, outputDir, errorDir = origIn, origOut, origErr }()
+
+	const n = 10
+	csvBody := "INTERNAL_ID,FIRST_NAME,MIDDLE_NAME,LAST_NAME,PHONE_NUM\n12345678,Jane,,Doe,123-456-7890\n"
+	paths := make([]string, n)
+	for i := 0; i < n; i++ {
+		p := filepath.Join(inputDir, fmt.Sprintf("f%d.csv", i))
+		if err := os.WriteFile(p, []byte(csvBody), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths[i] = p
+	}
+
+	jobs := make(chan string, n)
+	var workerWg sync.WaitGroup
+	const workers = 3
+	for i := 0; i < workers; i++ {
+		workerWg.Add(1)
+		go worker(i, jobs, &workerWg)
+	}
+	for _, p := range paths {
+		enqueue(jobs, p)
+	}
+
+	// same drain sequence as main()'s shutdown handler: close jobs, then
+	// wait for the pool before considering shutdown complete.
+	close(jobs)
+	workerWg.Wait()
+
+	for _, p := range paths {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("expected input %q to be removed after successful processing, stat err: %v", p, err)
+		}
+		outPath, err := mirroredPath(p, outputDir, outputFormat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(outPath); err != nil {
+			t.Errorf("expected output %q to exist after drain, stat err: %v", outPath, err)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+// vim: set ts=2 sw=2 :
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// metricsAddr is the listen address for the /metrics endpoint; the
+	// endpoint is disabled when this is empty.
+	metricsAddr string
+
+	filesProcessedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "files_processed_total",
+		Help: "Total number of input files successfully processed.",
+	})
+	recordsEmittedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "records_emitted_total",
+		Help: "Total number of records written to output.",
+	})
+	recordErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "record_errors_total",
+		Help: "Total number of row-level errors, labeled by error code.",
+	}, []string{"code"})
+	fileProcessingDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "file_processing_duration_seconds",
+		Help:    "Time taken to process a single input file, in seconds.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+// serveMetrics starts the /metrics HTTP endpoint on addr in the background.
+// It is a no-op if addr is empty.
+func serveMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		logrus.WithField("addr", addr).Info("serving /metrics")
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logrus.WithError(err).Error("metrics server exited")
+		}
+	}()
+}
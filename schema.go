@@ -0,0 +1,183 @@
+// vim: set ts=2 sw=2 :
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FieldRule describes the validation and mapping constraints for a single
+// output field, loaded from the -schema file. It replaces the hard-coded
+// ID/FNAME/... checks that used to live inline in processFile.
+type FieldRule struct {
+	// Name is the output field name (dot-separated for nesting, e.g. "name.first")
+	Name string `json:"name" yaml:"name"`
+	// Source is the input column/key name; defaults to Name if empty
+	Source string `json:"source" yaml:"source"`
+	// Type is one of "string" (default), "int", or "float"
+	Type string `json:"type" yaml:"type"`
+	// Required marks the field as mandatory; empty values are rejected
+	Required bool `json:"required" yaml:"required"`
+	// MinLength/MaxLength bound the length of string values
+	MinLength int `json:"minLength" yaml:"minLength"`
+	MaxLength int `json:"maxLength" yaml:"maxLength"`
+	// Min/Max bound numeric values (Type "int" or "float")
+	Min *float64 `json:"min" yaml:"min"`
+	Max *float64 `json:"max" yaml:"max"`
+	// Pattern is an optional regexp the value must match
+	Pattern string `json:"pattern" yaml:"pattern"`
+
+	compiled *regexp.Regexp
+}
+
+// Schema is an ordered set of field rules describing how to validate and map
+// a decoded RawRow into a Record.
+type Schema struct {
+	Fields []FieldRule `json:"fields" yaml:"fields"`
+}
+
+// loadSchema reads a JSON or YAML schema file, selecting the decoder by
+// extension (.yaml/.yml use YAML, anything else is treated as JSON).
+func loadSchema(path string) (*Schema, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("err: could not read schema file: %w", err)
+	}
+	var schema Schema
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".yaml" || ext == ".yml" {
+		err = yaml.Unmarshal(data, &schema)
+	} else {
+		err = json.Unmarshal(data, &schema)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("err: could not parse schema file: %w", err)
+	}
+	if err := schema.compile(); err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+// compile fills in defaults and pre-compiles regexp patterns for each field
+// rule; it is called both after loading a schema file and when constructing
+// the built-in default schema in code.
+func (s *Schema) compile() error {
+	for i, f := range s.Fields {
+		if f.Source == "" {
+			s.Fields[i].Source = f.Name
+		}
+		if f.Pattern != "" {
+			re, err := regexp.Compile(f.Pattern)
+			if err != nil {
+				return fmt.Errorf("err: field %q has invalid pattern %q: %w", f.Name, f.Pattern, err)
+			}
+			s.Fields[i].compiled = re
+		}
+	}
+	return nil
+}
+
+// validate applies the schema's rules to row, returning the mapped Record
+// and any validation errors found. validate checks every field of the row in
+// one pass and collects the first violation of each failing field, so callers
+// can report them together; later checks on a field that already failed are
+// skipped.
+func (s *Schema) validate(row RawRow) (Record, []*ValidationError) {
+	rec := Record{}
+	var errs []*ValidationError
+	for _, f := range s.Fields {
+		raw, exists := row[f.Source]
+		if f.Required && (!exists || raw == "") {
+			errs = append(errs, &ValidationError{Field: f.Name, Code: fieldCode(f.Name, "REQUIRED"), Message: fmt.Sprintf("err: missing required field %q", f.Name)})
+			continue
+		}
+		if !exists {
+			continue
+		}
+		if !f.Required && raw == "" {
+			// Mirrors the `json:",omitempty"` behavior of the original
+			// ID/FNAME/... struct: a blank optional field is left out of
+			// the record rather than round-tripped as an empty string.
+			continue
+		}
+		if f.MinLength > 0 && len(raw) < f.MinLength {
+			errs = append(errs, &ValidationError{Field: f.Name, Code: fieldCode(f.Name, "LENGTH"), Message: fmt.Sprintf("err: field %q: %q is shorter than minimum length %d", f.Name, raw, f.MinLength)})
+			continue
+		}
+		if f.MaxLength > 0 && len(raw) > f.MaxLength {
+			errs = append(errs, &ValidationError{Field: f.Name, Code: fieldCode(f.Name, "LENGTH"), Message: fmt.Sprintf("err: field %q: %q exceeds maximum length %d", f.Name, raw, f.MaxLength)})
+			continue
+		}
+		if f.compiled != nil && !f.compiled.MatchString(raw) {
+			errs = append(errs, &ValidationError{Field: f.Name, Code: fieldCode(f.Name, "FORMAT"), Message: fmt.Sprintf("err: field %q: %q does not match pattern %q", f.Name, raw, f.Pattern)})
+			continue
+		}
+
+		var value interface{} = raw
+		switch f.Type {
+		case "int":
+			n, err := strconv.Atoi(raw)
+			if err != nil {
+				errs = append(errs, &ValidationError{Field: f.Name, Code: fieldCode(f.Name, "TYPE"), Message: fmt.Sprintf("err: field %q: %q is not a valid integer", f.Name, raw)})
+				continue
+			}
+			if !withinRange(float64(n), f.Min, f.Max) {
+				errs = append(errs, &ValidationError{Field: f.Name, Code: fieldCode(f.Name, "RANGE"), Message: fmt.Sprintf("err: field %q: %d is outside allowed range", f.Name, n)})
+				continue
+			}
+			value = n
+		case "float":
+			n, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				errs = append(errs, &ValidationError{Field: f.Name, Code: fieldCode(f.Name, "TYPE"), Message: fmt.Sprintf("err: field %q: %q is not a valid number", f.Name, raw)})
+				continue
+			}
+			if !withinRange(n, f.Min, f.Max) {
+				errs = append(errs, &ValidationError{Field: f.Name, Code: fieldCode(f.Name, "RANGE"), Message: fmt.Sprintf("err: field %q: %v is outside allowed range", f.Name, n)})
+				continue
+			}
+			value = n
+		}
+		setNested(rec, f.Name, value)
+	}
+	return rec, errs
+}
+
+// withinRange reports whether v falls within [min, max], treating a nil
+// bound as unbounded on that side.
+func withinRange(v float64, min, max *float64) bool {
+	if min != nil && v < *min {
+		return false
+	}
+	if max != nil && v > *max {
+		return false
+	}
+	return true
+}
+
+// setNested assigns value into rec at a dot-separated path, creating
+// intermediate maps as needed (e.g. "name.first" -> rec["name"]["first"]).
+func setNested(rec Record, path string, value interface{}) {
+	parts := strings.Split(path, ".")
+	cur := rec
+	for i, part := range parts {
+		if i == len(parts)-1 {
+			cur[part] = value
+			return
+		}
+		next, ok := cur[part].(Record)
+		if !ok {
+			next = Record{}
+			cur[part] = next
+		}
+		cur = next
+	}
+}
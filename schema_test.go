@@ -0,0 +1,68 @@
+// vim: set ts=2 sw=2 :
+package main
+
+import "testing"
+
+// TestSchemaValidateNestedField checks that a dotted field name like
+// "name.first" ends up as a nested Record rather than a flat "name.first"
+// key, and that setNested creates intermediate maps as needed.
+func TestSchemaValidateNestedField(t *testing.T) {
+	s := &Schema{Fields: []FieldRule{
+		{Name: "name.first", Source: "FIRST", Required: true},
+		{Name: "name.last", Source: "LAST", Required: true},
+	}}
+	if err := s.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	rec, errs := s.validate(RawRow{"FIRST": "John", "LAST": "Doe"})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected validation errors: %v", errs)
+	}
+	name, ok := rec["name"].(Record)
+	if !ok {
+		t.Fatalf("expected rec[\"name\"] to be a nested Record, got %#v", rec["name"])
+	}
+	if name["first"] != "John" || name["last"] != "Doe" {
+		t.Errorf("got nested record %#v", name)
+	}
+}
+
+// TestSchemaValidateOptionalFieldOmitted checks that a blank, non-required
+// field is left out of the record instead of being set to "", matching the
+// omitempty behavior of the original hard-coded struct.
+func TestSchemaValidateOptionalFieldOmitted(t *testing.T) {
+	s := &Schema{Fields: []FieldRule{
+		{Name: "name.middle", Source: "MIDDLE", MaxLength: 15},
+	}}
+	if err := s.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	rec, errs := s.validate(RawRow{"MIDDLE": ""})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected validation errors: %v", errs)
+	}
+	if _, ok := rec["name"]; ok {
+		t.Errorf("expected blank optional field to be omitted, got %#v", rec)
+	}
+}
+
+// TestSchemaValidateRequiredMissing checks that a missing required field is
+// reported with a field-specific error code.
+func TestSchemaValidateRequiredMissing(t *testing.T) {
+	s := &Schema{Fields: []FieldRule{
+		{Name: "name.first", Source: "FIRST", Required: true},
+	}}
+	if err := s.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, errs := s.validate(RawRow{})
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 validation error, got %d: %v", len(errs), errs)
+	}
+	if errs[0].Code != "ERR_NAME_FIRST_REQUIRED" {
+		t.Errorf("unexpected error code %q", errs[0].Code)
+	}
+}
@@ -0,0 +1,189 @@
+// vim: set ts=2 sw=2 :
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// hashPrefixBytes is how many leading bytes of a file are hashed when
+// fingerprinting it for the state store; hashing the whole file would be
+// too slow for large inputs, but the first chunk is enough to detect most
+// in-place edits alongside size and modtime.
+const hashPrefixBytes = 4096
+
+// StateStatus is the lifecycle status of a tracked input file.
+type StateStatus string
+
+const (
+	StatePending   StateStatus = "pending"
+	StateSucceeded StateStatus = "succeeded"
+	StateFailed    StateStatus = "failed"
+)
+
+// StateEntry records what happened the last time a given file fingerprint
+// was processed.
+type StateEntry struct {
+	// Path is the input file's path at the time it was processed
+	Path string `json:"path"`
+	// Size is the file size in bytes at the time it was fingerprinted
+	Size int64 `json:"size"`
+	// ModTime is the file's modification time at the time it was fingerprinted
+	ModTime time.Time `json:"modTime"`
+	// Hash is a sha256 of the first hashPrefixBytes bytes of the file
+	Hash string `json:"hash"`
+	// Status is the outcome of the most recent processing attempt
+	Status StateStatus `json:"status"`
+	// OutputPath is where the produced output was written, if any
+	OutputPath string `json:"outputPath,omitempty"`
+	// Error is the failure message, if Status is StateFailed
+	Error string `json:"error,omitempty"`
+	// UpdatedAt is when this entry was last written
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// fingerprint uniquely identifies an entry by (path, size, modtime, hash) so
+// re-processing a file that was edited in place doesn't get skipped as
+// already-succeeded. Size and ModTime matter on their own, not just as
+// inputs to the hash: hashPrefixBytes only covers the first chunk of the
+// file, so an in-place edit past that offset (e.g. an appended row) changes
+// size and modtime but not the hash, and would otherwise fingerprint
+// identically to the original.
+func (e StateEntry) fingerprint() string {
+	return fmt.Sprintf("%s|%d|%s|%s", e.Path, e.Size, e.ModTime.UTC().Format(time.RFC3339Nano), e.Hash)
+}
+
+// StateStore is a JSON manifest of StateEntries under -state-dir, letting a
+// restart skip files that already succeeded instead of reprocessing (and
+// re-emitting) them.
+type StateStore struct {
+	mu      sync.Mutex
+	saveMu  sync.Mutex
+	path    string
+	entries map[string]StateEntry
+}
+
+// loadStateStore reads the manifest at <dir>/state.json, returning an empty
+// store if it doesn't exist yet.
+func loadStateStore(dir string) (*StateStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	store := &StateStore{path: filepath.Join(dir, "state.json"), entries: map[string]StateEntry{}}
+	data, err := ioutil.ReadFile(store.path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []StateEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		store.entries[e.fingerprint()] = e
+	}
+	return store, nil
+}
+
+// fingerprintFile stats and hashes path, producing the StateEntry key used
+// to look up or record its processing status.
+func fingerprintFile(path string) (StateEntry, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return StateEntry{}, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return StateEntry{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.CopyN(h, f, hashPrefixBytes); err != nil && err != io.EOF {
+		return StateEntry{}, err
+	}
+	return StateEntry{
+		Path:    path,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Hash:    hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// alreadySucceeded reports whether path, at its current size/modtime/hash,
+// was already processed successfully.
+func (s *StateStore) alreadySucceeded(path string) bool {
+	entry, err := fingerprintFile(path)
+	if err != nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.entries[entry.fingerprint()]
+	return ok && existing.Status == StateSucceeded
+}
+
+// record fingerprints path and stores status/outputPath/errMsg under it,
+// persisting the manifest to disk before returning.
+func (s *StateStore) record(path string, status StateStatus, outputPath, errMsg string) error {
+	entry, err := fingerprintFile(path)
+	if err != nil {
+		return err
+	}
+	entry.Status = status
+	entry.OutputPath = outputPath
+	entry.Error = errMsg
+	entry.UpdatedAt = time.Now()
+
+	s.mu.Lock()
+	s.entries[entry.fingerprint()] = entry
+	s.mu.Unlock()
+	return s.save()
+}
+
+// clear removes every entry recorded for path, regardless of fingerprint, so
+// a subsequent scan reprocesses it even if its bytes are unchanged. This
+// backs the -reprocess flag.
+func (s *StateStore) clear(path string) error {
+	s.mu.Lock()
+	for key, entry := range s.entries {
+		if entry.Path == path {
+			delete(s.entries, key)
+		}
+	}
+	s.mu.Unlock()
+	return s.save()
+}
+
+// save atomically writes the current entries to the manifest file. saveMu
+// serializes the whole snapshot-then-write-then-rename sequence across
+// concurrent callers (e.g. multiple workers finishing at once): without it,
+// two overlapping saves can race their renames and the slower one, holding
+// an earlier and thus incomplete snapshot, clobbers the manifest with data
+// that's missing whatever the other caller just recorded.
+func (s *StateStore) save() error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.mu.Lock()
+	entries := make([]StateEntry, 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, e)
+	}
+	s.mu.Unlock()
+
+	return atomicWriteFile(s.path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	})
+}
@@ -0,0 +1,93 @@
+// vim: set ts=2 sw=2 :
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// scanInputDir returns every regular file under inputDir matching pattern (a
+// doublestar-style glob such as "*.csv" or "**/*.{csv,tsv}"). When recursive
+// is false, matching is restricted to files directly in inputDir.
+func scanInputDir(pattern string, recursive bool) ([]string, error) {
+	var matches []string
+	err := filepath.Walk(inputDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if !recursive && path != inputDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(inputDir, path)
+		if err != nil {
+			return err
+		}
+		ok, err := doublestar.Match(pattern, filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		if ok {
+			matches = append(matches, path)
+		}
+		return nil
+	})
+	return matches, err
+}
+
+// matchesPattern reports whether path (which must live under inputDir)
+// matches the configured input pattern, for filtering fsnotify events.
+func matchesPattern(path, pattern string) bool {
+	rel, err := filepath.Rel(inputDir, path)
+	if err != nil {
+		return false
+	}
+	ok, err := doublestar.Match(pattern, filepath.ToSlash(rel))
+	if err != nil {
+		logrus.WithError(err).WithField("pattern", pattern).Error("invalid input pattern")
+		return false
+	}
+	return ok
+}
+
+// addRecursiveWatches registers root and every subdirectory beneath it with
+// watcher, since fsnotify only watches the directories it is explicitly told
+// about.
+func addRecursiveWatches(watcher *fsnotify.Watcher, root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if err := watcher.Add(path); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// mirroredPath maps an input file path to its counterpart under destDir,
+// preserving the path relative to inputDir (e.g. input/tenantA/f.csv ->
+// destDir/tenantA/f.<ext>), creating any intermediate directories needed.
+func mirroredPath(path, destDir, newExt string) (string, error) {
+	rel, err := filepath.Rel(inputDir, path)
+	if err != nil {
+		rel = filepath.Base(path)
+	}
+	ext := filepath.Ext(rel)
+	if newExt != "" {
+		rel = rel[:len(rel)-len(ext)] + "." + newExt
+	}
+	dest := filepath.Join(destDir, rel)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+	return dest, nil
+}